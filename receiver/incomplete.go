@@ -0,0 +1,128 @@
+package receiver
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const incompleteShardCount = 16
+
+// incompleteRecord is one buffered, not-yet-complete line from a peer.
+type incompleteRecord struct {
+	key      string
+	deadline time.Time
+	data     []byte
+}
+
+// incompleteShard holds a subset of peers, chosen by FNV hash of the peer
+// address, so shards can be accessed concurrently without contending on a
+// single lock.
+type incompleteShard struct {
+	mu      sync.Mutex
+	records map[string]*list.Element
+	order   *list.List // list.Element.Value is *incompleteRecord, front = most recently used
+	bytes   int
+}
+
+// incompleteStorage stores incomplete datagram lines keyed by peer address.
+// It is sharded for concurrent access (e.g. from a parser worker pool) and
+// bounds memory with both an entry-count and a byte budget per shard,
+// evicting the least recently used fragment when either is exceeded. The
+// pop/store API is unchanged from the original unsharded implementation.
+type incompleteStorage struct {
+	shards   [incompleteShardCount]*incompleteShard
+	Expires  time.Duration
+	MaxSize  int
+	MaxBytes int
+	evicted  *uint32
+}
+
+func newIncompleteStorage() *incompleteStorage {
+	storage := &incompleteStorage{
+		Expires:  5 * time.Second,
+		MaxSize:  10000,
+		MaxBytes: 10000 * 2048,
+		evicted:  new(uint32),
+	}
+	for i := range storage.shards {
+		storage.shards[i] = &incompleteShard{
+			records: make(map[string]*list.Element),
+			order:   list.New(),
+		}
+	}
+	return storage
+}
+
+func (storage *incompleteStorage) shardFor(addr string) *incompleteShard {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return storage.shards[h.Sum32()%incompleteShardCount]
+}
+
+func (storage *incompleteStorage) store(addr string, data []byte) {
+	shard := storage.shardFor(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if el, ok := shard.records[addr]; ok {
+		shard.bytes -= len(el.Value.(*incompleteRecord).data)
+		shard.order.Remove(el)
+		delete(shard.records, addr)
+	}
+
+	record := &incompleteRecord{
+		key:      addr,
+		deadline: time.Now().Add(storage.Expires),
+		data:     data,
+	}
+	el := shard.order.PushFront(record)
+	shard.records[addr] = el
+	shard.bytes += len(data)
+
+	maxEntries := storage.MaxSize / incompleteShardCount
+	maxBytes := storage.MaxBytes / incompleteShardCount
+
+	for (maxEntries > 0 && len(shard.records) > maxEntries) || (maxBytes > 0 && shard.bytes > maxBytes) {
+		oldest := shard.order.Back()
+		if oldest == nil {
+			break
+		}
+		oldRecord := oldest.Value.(*incompleteRecord)
+		shard.order.Remove(oldest)
+		delete(shard.records, oldRecord.key)
+		shard.bytes -= len(oldRecord.data)
+		atomic.AddUint32(storage.evicted, 1)
+	}
+}
+
+func (storage *incompleteStorage) pop(addr string) []byte {
+	shard := storage.shardFor(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	el, ok := shard.records[addr]
+	if !ok {
+		return nil
+	}
+
+	record := el.Value.(*incompleteRecord)
+	shard.order.Remove(el)
+	delete(shard.records, addr)
+	shard.bytes -= len(record.data)
+
+	if record.deadline.Before(time.Now()) {
+		return nil
+	}
+	return record.data
+}
+
+// evictedCount returns and resets the number of fragments evicted since the
+// last call, for the udp.incompleteEvicted stat.
+func (storage *incompleteStorage) evictedCount() uint32 {
+	n := atomic.LoadUint32(storage.evicted)
+	atomic.AddUint32(storage.evicted, -n)
+	return n
+}
@@ -0,0 +1,124 @@
+package receiver
+
+import "testing"
+
+func TestIncompleteStoragePopStore(t *testing.T) {
+	storage := newIncompleteStorage()
+
+	if got := storage.pop("1.2.3.4:1"); got != nil {
+		t.Fatalf("expected nil for unknown peer, got %#v", got)
+	}
+
+	storage.store("1.2.3.4:1", []byte("partial"))
+	if got := storage.pop("1.2.3.4:1"); string(got) != "partial" {
+		t.Fatalf("unexpected data: %#v", string(got))
+	}
+
+	// pop removes the entry.
+	if got := storage.pop("1.2.3.4:1"); got != nil {
+		t.Fatalf("expected nil after pop, got %#v", got)
+	}
+}
+
+func TestIncompleteStorageStoreReplacesExisting(t *testing.T) {
+	storage := newIncompleteStorage()
+
+	storage.store("1.2.3.4:1", []byte("first"))
+	storage.store("1.2.3.4:1", []byte("second"))
+
+	if got := storage.pop("1.2.3.4:1"); string(got) != "second" {
+		t.Fatalf("unexpected data: %#v", string(got))
+	}
+
+	shard := storage.shardFor("1.2.3.4:1")
+	if shard.bytes != 0 {
+		t.Fatalf("expected byte accounting to be zeroed after pop, got %d", shard.bytes)
+	}
+}
+
+func TestIncompleteStorageEvictsOldestOnMaxSize(t *testing.T) {
+	storage := newIncompleteStorage()
+	storage.MaxSize = incompleteShardCount // exactly one entry per shard
+	storage.MaxBytes = 0
+
+	shard := storage.shardFor("peer-a")
+	second := findPeerInShard(t, storage, shard, "peer-a")
+
+	storage.store("peer-a", []byte("aaaa"))
+	storage.store(second, []byte("bbbb"))
+
+	if storage.evictedCount() != 1 {
+		t.Fatalf("expected exactly 1 eviction once the one-entry-per-shard budget is exceeded")
+	}
+	if got := storage.pop("peer-a"); got != nil {
+		t.Fatalf("expected the oldest entry (peer-a) to have been evicted, got %#v", got)
+	}
+	if got := storage.pop(second); string(got) != "bbbb" {
+		t.Fatalf("expected the newest entry to survive, got %#v", string(got))
+	}
+}
+
+func TestIncompleteStorageEvictsOnMaxBytes(t *testing.T) {
+	storage := newIncompleteStorage()
+	storage.MaxSize = 0
+	storage.MaxBytes = incompleteShardCount * 4 // 4 bytes per shard
+
+	shard := storage.shardFor("peer-a")
+	second := findPeerInShard(t, storage, shard, "peer-a")
+
+	storage.store("peer-a", []byte("aaaa"))
+	storage.store(second, []byte("bbbb"))
+
+	if storage.evictedCount() != 1 {
+		t.Fatalf("expected exactly 1 eviction once the byte budget is exceeded")
+	}
+	if got := storage.pop("peer-a"); got != nil {
+		t.Fatalf("expected the oldest entry to have been evicted on byte budget, got %#v", got)
+	}
+}
+
+func TestIncompleteStorageEvictedCountResets(t *testing.T) {
+	storage := newIncompleteStorage()
+	storage.MaxSize = incompleteShardCount // exactly one entry per shard
+	storage.MaxBytes = 0
+
+	shard := storage.shardFor("peer-a")
+	second := findPeerInShard(t, storage, shard, "peer-a")
+
+	storage.store("peer-a", []byte("a"))
+	storage.store(second, []byte("b"))
+
+	if n := storage.evictedCount(); n != 1 {
+		t.Fatalf("expected 1 eviction, got %d", n)
+	}
+	if n := storage.evictedCount(); n != 0 {
+		t.Fatalf("expected evictedCount to reset to 0 after reading, got %d", n)
+	}
+}
+
+// findPeerInShard returns a synthetic peer key, distinct from exclude, that
+// hashes to the same shard, so eviction tests can force two entries to
+// contend for one shard's entry/byte budget.
+func findPeerInShard(t *testing.T, storage *incompleteStorage, shard *incompleteShard, exclude string) string {
+	t.Helper()
+	for n := 1; n < 100000; n++ {
+		candidate := syntheticPeerKey(n)
+		if candidate != exclude && storage.shardFor(candidate) == shard {
+			return candidate
+		}
+	}
+	t.Fatalf("could not find a synthetic peer key colliding with the target shard")
+	return ""
+}
+
+func syntheticPeerKey(n int) string {
+	digits := "0123456789"
+	key := make([]byte, 0, 16)
+	key = append(key, "10.0.0."...)
+	for n > 0 {
+		key = append(key, digits[n%10])
+		n /= 10
+	}
+	key = append(key, ":1"...)
+	return string(key)
+}
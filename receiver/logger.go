@@ -0,0 +1,34 @@
+package receiver
+
+import "github.com/Sirupsen/logrus"
+
+// Logger is the minimal structured logging interface used by receivers.
+// It lets operators embedding go-carbon route receiver events (and their
+// key-value fields, e.g. peer/bytes/error) into their own logging stack
+// instead of the bundled logrus setup.
+type Logger interface {
+	Debug(msg string, fields map[string]interface{})
+	Info(msg string, fields map[string]interface{})
+	Warn(msg string, fields map[string]interface{})
+	Error(msg string, fields map[string]interface{})
+}
+
+// logrusLogger adapts the package-wide logrus logger to the Logger
+// interface. It is the default used by receivers for backward compat.
+type logrusLogger struct{}
+
+func (logrusLogger) Debug(msg string, fields map[string]interface{}) {
+	logrus.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+
+func (logrusLogger) Info(msg string, fields map[string]interface{}) {
+	logrus.WithFields(logrus.Fields(fields)).Info(msg)
+}
+
+func (logrusLogger) Warn(msg string, fields map[string]interface{}) {
+	logrus.WithFields(logrus.Fields(fields)).Warn(msg)
+}
+
+func (logrusLogger) Error(msg string, fields map[string]interface{}) {
+	logrus.WithFields(logrus.Fields(fields)).Error(msg)
+}
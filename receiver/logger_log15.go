@@ -0,0 +1,39 @@
+package receiver
+
+import "github.com/inconshreveable/log15"
+
+// Log15Logger adapts a log15.Logger to the receiver Logger interface, for
+// operators who want receiver events (and their correlation fields such as
+// peer/bytes/error) routed through log15 instead of logrus.
+type Log15Logger struct {
+	Logger log15.Logger
+}
+
+// NewLog15Logger wraps logger as a receiver.Logger.
+func NewLog15Logger(logger log15.Logger) *Log15Logger {
+	return &Log15Logger{Logger: logger}
+}
+
+func (l *Log15Logger) Debug(msg string, fields map[string]interface{}) {
+	l.Logger.Debug(msg, toLog15Ctx(fields)...)
+}
+
+func (l *Log15Logger) Info(msg string, fields map[string]interface{}) {
+	l.Logger.Info(msg, toLog15Ctx(fields)...)
+}
+
+func (l *Log15Logger) Warn(msg string, fields map[string]interface{}) {
+	l.Logger.Warn(msg, toLog15Ctx(fields)...)
+}
+
+func (l *Log15Logger) Error(msg string, fields map[string]interface{}) {
+	l.Logger.Error(msg, toLog15Ctx(fields)...)
+}
+
+func toLog15Ctx(fields map[string]interface{}) []interface{} {
+	ctx := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		ctx = append(ctx, k, v)
+	}
+	return ctx
+}
@@ -0,0 +1,40 @@
+package receiver
+
+import "log/slog"
+
+// SlogLogger adapts a *slog.Logger to the receiver Logger interface, for
+// operators who want receiver events (and their correlation fields such as
+// peer/bytes/error) routed through the standard library's structured
+// logging instead of logrus.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+// NewSlogLogger wraps logger as a receiver.Logger.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{Logger: logger}
+}
+
+func (l *SlogLogger) Debug(msg string, fields map[string]interface{}) {
+	l.Logger.Debug(msg, toSlogArgs(fields)...)
+}
+
+func (l *SlogLogger) Info(msg string, fields map[string]interface{}) {
+	l.Logger.Info(msg, toSlogArgs(fields)...)
+}
+
+func (l *SlogLogger) Warn(msg string, fields map[string]interface{}) {
+	l.Logger.Warn(msg, toSlogArgs(fields)...)
+}
+
+func (l *SlogLogger) Error(msg string, fields map[string]interface{}) {
+	l.Logger.Error(msg, toSlogArgs(fields)...)
+}
+
+func toSlogArgs(fields map[string]interface{}) []interface{} {
+	args := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return args
+}
@@ -0,0 +1,256 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// Parser turns a single inbound line into a Points value. Implementations
+// must be safe to call concurrently: the parser pool calls Parse from
+// multiple worker goroutines at once. Parser is for newline-delimited
+// textual formats only; binary formats that carry their own framing (e.g.
+// protobuf) implement DatagramParser instead.
+type Parser interface {
+	Parse(line []byte) (*points.Points, error)
+}
+
+// DatagramParser is implemented by wire formats that frame themselves
+// (e.g. a length prefix) instead of relying on newlines to separate
+// messages. When one is configured via SetDatagramParser, parser workers
+// hand it whole reassembled datagrams and skip the newline-delimited line
+// splitter entirely, since a binary payload can legitimately contain
+// 0x0A/0x0D bytes that are not message boundaries.
+type DatagramParser interface {
+	// ParseDatagram decodes as many complete frames as payload contains,
+	// returning one *points.Points per point across all of them. Any
+	// trailing bytes that do not yet form a complete frame are returned in
+	// rest, to be concatenated with the next datagram from the same peer
+	// (the same reassembly incompleteStorage already does for text lines).
+	ParseDatagram(payload []byte) (msgs []*points.Points, rest []byte, err error)
+}
+
+// SetParser overrides the wire format used to decode inbound lines,
+// defaulting to the plaintext Graphite format (points.ParseText). Use this
+// to accept Graphite-with-tags or JSON encoded metrics on a listener
+// instead. For protobuf, use SetDatagramParser.
+func (rcv *UDP) SetParser(parser Parser) {
+	rcv.parser = parser
+}
+
+// SetDatagramParser configures a binary, self-framing wire format such as
+// ProtobufParser. When set, it takes priority over Parser: parser workers
+// bypass the newline-delimited line splitter for this listener entirely.
+func (rcv *UDP) SetDatagramParser(parser DatagramParser) {
+	rcv.datagramParser = parser
+}
+
+// plainTextParser decodes the classic "metric value timestamp" Graphite
+// line format via points.ParseText.
+type plainTextParser struct{}
+
+func (plainTextParser) Parse(line []byte) (*points.Points, error) {
+	return points.ParseText(string(line))
+}
+
+// TagsParser decodes Graphite-with-tags lines of the form
+// "metric;tag1=v1;tag2=v2 value timestamp". Tags are appended to the
+// metric name in the same ";k=v" form carbon-tagger style backends expect;
+// go-carbon itself stores the line as-is and leaves tag indexing to readers.
+type TagsParser struct{}
+
+func (TagsParser) Parse(line []byte) (*points.Points, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("bad tagged line %#v", string(line))
+	}
+
+	name := fields[0]
+	if !strings.Contains(name, ";") {
+		return nil, fmt.Errorf("tagged line %#v has no tags", string(line))
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value in tagged line %#v: %s", string(line), err)
+	}
+
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp in tagged line %#v: %s", string(line), err)
+	}
+
+	return points.OnePoint(name, value, timestamp), nil
+}
+
+// jsonLine is the wire shape accepted by JSONParser.
+type jsonLine struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Time  int64   `json:"time"`
+}
+
+// JSONParser decodes a single JSON object per line:
+// {"name": "metric.name", "value": 42, "time": 1234567890}.
+type JSONParser struct{}
+
+func (JSONParser) Parse(line []byte) (*points.Points, error) {
+	var msg jsonLine
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, fmt.Errorf("bad json line %#v: %s", string(line), err)
+	}
+	if msg.Name == "" {
+		return nil, fmt.Errorf("json line %#v has no name", string(line))
+	}
+	return points.OnePoint(msg.Name, msg.Value, msg.Time), nil
+}
+
+// ProtobufParser decodes go-carbon's length-prefixed protobuf wire format:
+// each frame is a 4-byte big-endian length followed by that many bytes of a
+// protobuf-encoded Metric message:
+//
+//	message Point { int64 timestamp = 1; double value = 2; }
+//	message Metric { string metric = 1; repeated Point points = 2; }
+//
+// Frames are binary and may contain 0x0A/0x0D bytes anywhere, so they are
+// never run through the newline-delimited line splitter; decode via
+// ParseDatagram (DatagramParser), not Parse.
+type ProtobufParser struct{}
+
+// ParseDatagram splits payload into complete length-prefixed frames and
+// decodes each Metric message into one *points.Points per point in its
+// repeated points field. Any trailing bytes that don't yet form a complete
+// frame (including a partial 4-byte length prefix) are returned in rest.
+func (ProtobufParser) ParseDatagram(payload []byte) (msgs []*points.Points, rest []byte, err error) {
+	buf := payload
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return msgs, buf, nil
+		}
+
+		length := binary.BigEndian.Uint32(buf[:4])
+		if uint64(len(buf)-4) < uint64(length) {
+			return msgs, buf, nil
+		}
+
+		frame := buf[4 : 4+length]
+		buf = buf[4+length:]
+
+		framePoints, err := decodeProtobufMetric(frame)
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, framePoints...)
+	}
+	return msgs, nil, nil
+}
+
+// decodeProtobufMetric decodes a single protobuf-encoded Metric message,
+// returning one *points.Points per entry in its repeated points field.
+func decodeProtobufMetric(frame []byte) ([]*points.Points, error) {
+	var name string
+	var timestamps []int64
+	var values []float64
+
+	buf := frame
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad protobuf metric: malformed tag")
+		}
+		buf = buf[n:]
+
+		field := tag >> 3
+		wireType := tag & 0x7
+
+		switch field {
+		case 1: // metric (string, wire type 2)
+			if wireType != 2 {
+				return nil, fmt.Errorf("bad protobuf metric: unexpected wire type for metric field")
+			}
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return nil, fmt.Errorf("bad protobuf metric: truncated metric field")
+			}
+			buf = buf[n:]
+			name = string(buf[:length])
+			buf = buf[length:]
+
+		case 2: // points (repeated embedded message, wire type 2)
+			if wireType != 2 {
+				return nil, fmt.Errorf("bad protobuf metric: unexpected wire type for points field")
+			}
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return nil, fmt.Errorf("bad protobuf metric: truncated points field")
+			}
+			buf = buf[n:]
+			point := buf[:length]
+			buf = buf[length:]
+
+			timestamp, value, err := parseProtobufPoint(point)
+			if err != nil {
+				return nil, err
+			}
+			timestamps = append(timestamps, timestamp)
+			values = append(values, value)
+
+		default:
+			return nil, fmt.Errorf("bad protobuf metric: unknown field %d", field)
+		}
+	}
+
+	if name == "" || len(values) == 0 {
+		return nil, fmt.Errorf("bad protobuf metric: missing metric name or points")
+	}
+
+	result := make([]*points.Points, len(values))
+	for i := range values {
+		result[i] = points.OnePoint(name, values[i], timestamps[i])
+	}
+	return result, nil
+}
+
+func parseProtobufPoint(buf []byte) (timestamp int64, value float64, err error) {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, 0, fmt.Errorf("bad protobuf point: malformed tag")
+		}
+		buf = buf[n:]
+
+		field := tag >> 3
+		wireType := tag & 0x7
+
+		switch field {
+		case 1: // timestamp (varint, wire type 0)
+			if wireType != 0 {
+				return 0, 0, fmt.Errorf("bad protobuf point: unexpected wire type for timestamp field")
+			}
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return 0, 0, fmt.Errorf("bad protobuf point: malformed timestamp")
+			}
+			buf = buf[n:]
+			timestamp = int64(v)
+
+		case 2: // value (double, wire type 1)
+			if wireType != 1 || len(buf) < 8 {
+				return 0, 0, fmt.Errorf("bad protobuf point: malformed value")
+			}
+			bits := binary.LittleEndian.Uint64(buf[:8])
+			value = math.Float64frombits(bits)
+			buf = buf[8:]
+
+		default:
+			return 0, 0, fmt.Errorf("bad protobuf point: unknown field %d", field)
+		}
+	}
+
+	return timestamp, value, nil
+}
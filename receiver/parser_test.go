@@ -0,0 +1,206 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func encodeProtobufPoint(timestamp int64, value float64) []byte {
+	var buf []byte
+	buf = appendVarint(buf, (1<<3)|0) // timestamp, varint
+	buf = appendVarint(buf, uint64(timestamp))
+	buf = appendVarint(buf, (2<<3)|1) // value, fixed64
+	bits := math.Float64bits(value)
+	valBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(valBytes, bits)
+	buf = append(buf, valBytes...)
+	return buf
+}
+
+func encodeProtobufMetric(name string, pointPairs [][2]float64) []byte {
+	var buf []byte
+	buf = appendVarint(buf, (1<<3)|2) // metric, length-delimited
+	buf = appendVarint(buf, uint64(len(name)))
+	buf = append(buf, []byte(name)...)
+
+	for _, pair := range pointPairs {
+		point := encodeProtobufPoint(int64(pair[0]), pair[1])
+		buf = appendVarint(buf, (2<<3)|2) // points, length-delimited
+		buf = appendVarint(buf, uint64(len(point)))
+		buf = append(buf, point...)
+	}
+	return buf
+}
+
+func encodeProtobufFrame(metric []byte) []byte {
+	frame := make([]byte, 4+len(metric))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(metric)))
+	copy(frame[4:], metric)
+	return frame
+}
+
+func TestTagsParserValid(t *testing.T) {
+	pts, err := TagsParser{}.Parse([]byte("app.requests;region=us;env=prod 42.5 1234567890"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if pts.Metric != "app.requests;region=us;env=prod" {
+		t.Fatalf("unexpected metric: %#v", pts.Metric)
+	}
+	if len(pts.Data) != 1 || pts.Data[0].Value != 42.5 || pts.Data[0].Timestamp != 1234567890 {
+		t.Fatalf("unexpected data: %#v", pts.Data)
+	}
+}
+
+func TestTagsParserMalformed(t *testing.T) {
+	cases := []string{
+		"app.requests;region=us 42.5",                  // wrong field count
+		"app.requests 42.5 1234567890",                 // no tags at all
+		"app.requests;region=us notanumber 1234567890", // bad value
+		"app.requests;region=us 42.5 notatimestamp",    // bad timestamp
+	}
+	for _, c := range cases {
+		if _, err := (TagsParser{}).Parse([]byte(c)); err == nil {
+			t.Fatalf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestJSONParserValid(t *testing.T) {
+	pts, err := JSONParser{}.Parse([]byte(`{"name": "app.requests", "value": 42.5, "time": 1234567890}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if pts.Metric != "app.requests" {
+		t.Fatalf("unexpected metric: %#v", pts.Metric)
+	}
+	if len(pts.Data) != 1 || pts.Data[0].Value != 42.5 || pts.Data[0].Timestamp != 1234567890 {
+		t.Fatalf("unexpected data: %#v", pts.Data)
+	}
+}
+
+func TestJSONParserMalformed(t *testing.T) {
+	cases := []string{
+		`not json at all`,
+		`{"value": 42.5, "time": 1234567890}`, // missing name
+		`{"name": "", "value": 42.5, "time": 1234567890}`,
+	}
+	for _, c := range cases {
+		if _, err := (JSONParser{}).Parse([]byte(c)); err == nil {
+			t.Fatalf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestProtobufParserMultiPoint(t *testing.T) {
+	metric := encodeProtobufMetric("app.requests", [][2]float64{
+		{1000, 1.5},
+		{1010, 2.5},
+		{1020, 3.5},
+	})
+	payload := encodeProtobufFrame(metric)
+
+	msgs, rest, err := ProtobufParser{}.ParseDatagram(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected no trailing bytes, got %d", len(rest))
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 points (one per repeated Point), got %d", len(msgs))
+	}
+}
+
+func TestProtobufParserMultipleFramesInOneDatagram(t *testing.T) {
+	frameA := encodeProtobufFrame(encodeProtobufMetric("a.metric", [][2]float64{{1, 1}}))
+	frameB := encodeProtobufFrame(encodeProtobufMetric("b.metric", [][2]float64{{2, 2}, {3, 3}}))
+
+	payload := append(append([]byte{}, frameA...), frameB...)
+
+	msgs, rest, err := ProtobufParser{}.ParseDatagram(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected no trailing bytes, got %d", len(rest))
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 points across both frames, got %d", len(msgs))
+	}
+}
+
+func TestProtobufParserIncompleteFrame(t *testing.T) {
+	metric := encodeProtobufMetric("app.requests", [][2]float64{{1000, 1.5}})
+	frame := encodeProtobufFrame(metric)
+
+	// Split the frame mid-message, as a batched reader might hand us a
+	// datagram that ends before the message is complete.
+	split := len(frame) - 3
+	first, second := frame[:split], frame[split:]
+
+	msgs, rest, err := ProtobufParser{}.ParseDatagram(first)
+	if err != nil {
+		t.Fatalf("unexpected error on partial frame: %s", err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected no points from a partial frame, got %d", len(msgs))
+	}
+	if len(rest) == 0 {
+		t.Fatalf("expected the partial frame to be returned for reassembly")
+	}
+
+	// Reassemble as parseWorkerDatagrams would, and parse the rest.
+	rejoined := append(append([]byte{}, rest...), second...)
+	msgs, rest, err = ProtobufParser{}.ParseDatagram(rejoined)
+	if err != nil {
+		t.Fatalf("unexpected error on reassembled frame: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected no trailing bytes after reassembly, got %d", len(rest))
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 point after reassembly, got %d", len(msgs))
+	}
+}
+
+func TestProtobufParserMalformed(t *testing.T) {
+	_, _, err := ProtobufParser{}.ParseDatagram(encodeProtobufFrame([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	if err == nil {
+		t.Fatalf("expected error for malformed metric")
+	}
+}
+
+// TestProtobufParserSurvivesNewlineBytes is the regression test for framing
+// the protobuf payload through the newline-delimited line splitter: a
+// message whose name or encoded value happens to contain 0x0A/0x0D bytes
+// must decode intact, since ParseDatagram never looks for line delimiters.
+func TestProtobufParserSurvivesNewlineBytes(t *testing.T) {
+	// Value bits chosen so the little-endian encoding contains a 0x0A byte,
+	// and a metric name containing a literal 0x0D byte.
+	value := math.Float64frombits(0x0a00000000000000)
+	name := "weird.metric.\r.name"
+
+	metric := encodeProtobufMetric(name, [][2]float64{{42, value}})
+	payload := encodeProtobufFrame(metric)
+
+	msgs, rest, err := ProtobufParser{}.ParseDatagram(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected no trailing bytes, got %d", len(rest))
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 point, got %d", len(msgs))
+	}
+}
@@ -0,0 +1,128 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ProxyProtocolMode defines how a listener handles the HAProxy PROXY
+// protocol header that may precede the real payload of a connection or
+// datagram.
+type ProxyProtocolMode string
+
+const (
+	// ProxyProtocolDisabled never looks for a PROXY header. This is the default.
+	ProxyProtocolDisabled ProxyProtocolMode = "disabled"
+	// ProxyProtocolOptional parses a PROXY header when present, but falls
+	// back to the socket peer address when it is not.
+	ProxyProtocolOptional ProxyProtocolMode = "optional"
+	// ProxyProtocolRequired rejects any message that does not start with a
+	// valid PROXY header.
+	ProxyProtocolRequired ProxyProtocolMode = "required"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseProxyProtocolHeader strips a PROXY protocol v1 or v2 header from the
+// front of data, if one is present, and returns the address of the original
+// client together with the remaining payload. If data does not start with a
+// recognized header, ok is false and data is returned unchanged.
+func parseProxyProtocolHeader(data []byte) (addr *net.UDPAddr, rest []byte, ok bool, err error) {
+	if bytes.HasPrefix(data, proxyProtocolV2Signature) {
+		return parseProxyProtocolV2(data)
+	}
+	if bytes.HasPrefix(data, []byte("PROXY ")) {
+		return parseProxyProtocolV1(data)
+	}
+	return nil, data, false, nil
+}
+
+// parseProxyProtocolV1 parses a textual PROXY protocol header, e.g.
+// "PROXY TCP4 198.51.100.1 203.0.113.7 35230 8080\r\n".
+func parseProxyProtocolV1(data []byte) (addr *net.UDPAddr, rest []byte, ok bool, err error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 {
+		return nil, data, false, fmt.Errorf("proxy protocol v1: unterminated header")
+	}
+
+	fields := bytes.Fields(data[:idx])
+	if len(fields) < 2 {
+		return nil, data, false, fmt.Errorf("proxy protocol v1: malformed header %#v", string(data[:idx]))
+	}
+
+	proto := string(fields[1])
+	if proto == "UNKNOWN" {
+		// Per spec, UNKNOWN carries no address info: fall back to the
+		// socket peer rather than treating the header as malformed.
+		return nil, data[idx+2:], true, nil
+	}
+	if len(fields) < 5 {
+		return nil, data, false, fmt.Errorf("proxy protocol v1: malformed header %#v", string(data[:idx]))
+	}
+
+	ip := net.ParseIP(string(fields[2]))
+	if ip == nil {
+		return nil, data, false, fmt.Errorf("proxy protocol v1: invalid source address %#v", string(fields[2]))
+	}
+
+	var port int
+	if _, err := fmt.Sscanf(string(fields[4]), "%d", &port); err != nil {
+		return nil, data, false, fmt.Errorf("proxy protocol v1: invalid source port %#v", string(fields[4]))
+	}
+
+	return &net.UDPAddr{IP: ip, Port: port}, data[idx+2:], true, nil
+}
+
+// parseProxyProtocolV2 parses a binary PROXY protocol v2 header as defined
+// by the spec (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt).
+func parseProxyProtocolV2(data []byte) (addr *net.UDPAddr, rest []byte, ok bool, err error) {
+	const headerLen = 16
+	if len(data) < headerLen {
+		return nil, data, false, fmt.Errorf("proxy protocol v2: short header")
+	}
+
+	verCmd := data[12]
+	if verCmd>>4 != 2 {
+		return nil, data, false, fmt.Errorf("proxy protocol v2: unsupported version %d", verCmd>>4)
+	}
+
+	family := data[13]
+	addrLen := int(binary.BigEndian.Uint16(data[14:16]))
+
+	if len(data) < headerLen+addrLen {
+		return nil, data, false, fmt.Errorf("proxy protocol v2: truncated address block")
+	}
+
+	body := data[headerLen : headerLen+addrLen]
+	rest = data[headerLen+addrLen:]
+
+	// LOCAL command (0x20): no address info, keep the socket peer.
+	if verCmd&0xf == 0 {
+		return nil, rest, true, nil
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, data, false, fmt.Errorf("proxy protocol v2: truncated ipv4 address")
+		}
+		// Copy the IP out of body: body aliases data, which the caller may
+		// hand us straight out of a batch reader's reused read buffer, and
+		// addr can outlive this call by sitting in a parse queue.
+		ip := append(net.IP(nil), body[0:4]...)
+		port := binary.BigEndian.Uint16(body[8:10])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, rest, true, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, data, false, fmt.Errorf("proxy protocol v2: truncated ipv6 address")
+		}
+		ip := append(net.IP(nil), body[0:16]...)
+		port := binary.BigEndian.Uint16(body[32:34])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, rest, true, nil
+	default:
+		// AF_UNSPEC or AF_UNIX: nothing usable as a UDP peer.
+		return nil, rest, true, nil
+	}
+}
@@ -0,0 +1,202 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseProxyProtocolV1Valid(t *testing.T) {
+	data := []byte("PROXY TCP4 198.51.100.1 203.0.113.7 35230 8080\r\nhello\n")
+
+	addr, rest, ok, err := parseProxyProtocolHeader(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if addr == nil || addr.IP.String() != "198.51.100.1" || addr.Port != 35230 {
+		t.Fatalf("unexpected addr: %#v", addr)
+	}
+	if string(rest) != "hello\n" {
+		t.Fatalf("unexpected rest: %#v", string(rest))
+	}
+}
+
+func TestParseProxyProtocolV1Unknown(t *testing.T) {
+	data := []byte("PROXY UNKNOWN\r\nhello\n")
+
+	addr, rest, ok, err := parseProxyProtocolHeader(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true, PROXY UNKNOWN must fall back to the socket peer, not be rejected")
+	}
+	if addr != nil {
+		t.Fatalf("expected nil addr for UNKNOWN, got %#v", addr)
+	}
+	if string(rest) != "hello\n" {
+		t.Fatalf("unexpected rest: %#v", string(rest))
+	}
+}
+
+func TestParseProxyProtocolV1Truncated(t *testing.T) {
+	data := []byte("PROXY TCP4 198.51.100.1 203.0.113.7 35230 8080")
+
+	_, _, ok, err := parseProxyProtocolHeader(data)
+	if err == nil {
+		t.Fatalf("expected error for unterminated header")
+	}
+	if ok {
+		t.Fatalf("expected ok=false for unterminated header")
+	}
+}
+
+func TestParseProxyProtocolV1Malformed(t *testing.T) {
+	cases := []string{
+		"PROXY TCP4 198.51.100.1\r\n",
+		"PROXY TCP4 not-an-ip 203.0.113.7 35230 8080\r\n",
+		"PROXY TCP4 198.51.100.1 203.0.113.7 notaport 8080\r\n",
+	}
+
+	for _, c := range cases {
+		_, _, ok, err := parseProxyProtocolHeader([]byte(c))
+		if err == nil {
+			t.Fatalf("expected error for malformed header %#v", c)
+		}
+		if ok {
+			t.Fatalf("expected ok=false for malformed header %#v", c)
+		}
+	}
+}
+
+func TestParseProxyProtocolV1BarePrefixIsNotAHeader(t *testing.T) {
+	// "PROXY" with no trailing space before the line ending isn't a valid
+	// v1 header start ("PROXY "+proto), so it must be treated the same as
+	// "no header present" rather than as malformed.
+	data := []byte("PROXY\r\n")
+
+	addr, rest, ok, err := parseProxyProtocolHeader(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("expected ok=false, got addr=%#v", addr)
+	}
+	if !bytes.Equal(rest, data) {
+		t.Fatalf("expected data to be returned unchanged")
+	}
+}
+
+func buildProxyProtocolV2(t *testing.T, cmd byte, family byte, addrBody []byte, trailer []byte) []byte {
+	t.Helper()
+
+	header := make([]byte, 16)
+	copy(header, proxyProtocolV2Signature)
+	header[12] = 0x20 | cmd
+	header[13] = family
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrBody)))
+
+	buf := append(header, addrBody...)
+	buf = append(buf, trailer...)
+	return buf
+}
+
+func TestParseProxyProtocolV2Valid(t *testing.T) {
+	addrBody := make([]byte, 12)
+	copy(addrBody[0:4], net.ParseIP("198.51.100.1").To4())
+	copy(addrBody[4:8], net.ParseIP("203.0.113.7").To4())
+	binary.BigEndian.PutUint16(addrBody[8:10], 35230)
+	binary.BigEndian.PutUint16(addrBody[10:12], 8080)
+
+	data := buildProxyProtocolV2(t, 0x1, 0x11, addrBody, []byte("payload"))
+
+	addr, rest, ok, err := parseProxyProtocolHeader(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if addr == nil || addr.IP.String() != "198.51.100.1" || addr.Port != 35230 {
+		t.Fatalf("unexpected addr: %#v", addr)
+	}
+	if !bytes.Equal(rest, []byte("payload")) {
+		t.Fatalf("unexpected rest: %#v", string(rest))
+	}
+}
+
+func TestParseProxyProtocolV2DoesNotAliasInput(t *testing.T) {
+	addrBody := make([]byte, 12)
+	copy(addrBody[0:4], net.ParseIP("198.51.100.1").To4())
+	copy(addrBody[4:8], net.ParseIP("203.0.113.7").To4())
+	binary.BigEndian.PutUint16(addrBody[8:10], 35230)
+	binary.BigEndian.PutUint16(addrBody[10:12], 8080)
+
+	data := buildProxyProtocolV2(t, 0x1, 0x11, addrBody, nil)
+
+	addr, _, ok, err := parseProxyProtocolHeader(data)
+	if err != nil || !ok {
+		t.Fatalf("unexpected parse failure: ok=%v err=%s", ok, err)
+	}
+
+	// Simulate the batch reader overwriting its buffer on the next
+	// recvmmsg call, as linuxBatchReader does between ReadBatch calls.
+	for i := range data {
+		data[i] = 0xff
+	}
+
+	if addr.IP.String() != "198.51.100.1" {
+		t.Fatalf("addr.IP aliased the input buffer: got %s after overwrite", addr.IP.String())
+	}
+}
+
+func TestParseProxyProtocolV2Truncated(t *testing.T) {
+	addrBody := make([]byte, 12)
+	data := buildProxyProtocolV2(t, 0x1, 0x11, addrBody, nil)
+	data = data[:len(data)-4] // chop off part of the address block
+
+	_, _, ok, err := parseProxyProtocolHeader(data)
+	if err == nil {
+		t.Fatalf("expected error for truncated address block")
+	}
+	if ok {
+		t.Fatalf("expected ok=false for truncated address block")
+	}
+}
+
+func TestParseProxyProtocolV2UnsupportedVersion(t *testing.T) {
+	header := make([]byte, 16)
+	copy(header, proxyProtocolV2Signature)
+	header[12] = 0x10 // version 1, not 2
+	header[13] = 0x11
+
+	_, _, ok, err := parseProxyProtocolHeader(header)
+	if err == nil {
+		t.Fatalf("expected error for unsupported version")
+	}
+	if ok {
+		t.Fatalf("expected ok=false for unsupported version")
+	}
+}
+
+func TestParseProxyProtocolHeaderAbsent(t *testing.T) {
+	data := []byte("plain.metric 42 1234567890\n")
+
+	addr, rest, ok, err := parseProxyProtocolHeader(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("expected ok=false when no PROXY header is present")
+	}
+	if addr != nil {
+		t.Fatalf("expected nil addr when no PROXY header is present")
+	}
+	if !bytes.Equal(rest, data) {
+		t.Fatalf("expected data to be returned unchanged")
+	}
+}
@@ -3,15 +3,28 @@ package receiver
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lomik/go-carbon/points"
+)
 
-	"github.com/Sirupsen/logrus"
+// ParseDropPolicy selects what happens when a parser worker's queue is full.
+type ParseDropPolicy string
+
+const (
+	// ParseDropPolicyBlock makes the receive goroutine wait for queue space,
+	// applying backpressure instead of losing data. This is the default.
+	ParseDropPolicyBlock ParseDropPolicy = "block"
+	// ParseDropPolicyDrop discards the datagram and counts it in
+	// udp.parseDrops, trading data loss for a receive goroutine that never
+	// blocks on a slow parser worker.
+	ParseDropPolicyDrop ParseDropPolicy = "drop"
 )
 
 // UDP receive metrics from UDP socket
@@ -26,87 +39,148 @@ type UDP struct {
 	logIncomplete      bool
 	conn               *net.UDPConn
 	metricInterval     time.Duration
+	proxyProtocol      ProxyProtocolMode
+	logger             Logger
+	batchSize          int
+	readBufferSize     int
+	batchReads         uint32
+	batchDatagrams     uint32
+	parserWorkers      int
+	parseQueueSize     int
+	parseDropPolicy    ParseDropPolicy
+	parseQueues        []chan parseJob
+	parseDrops         uint32
+	parser             Parser
+	datagramParser     DatagramParser
+	incompleteMaxBytes int
+	lines              *incompleteStorage
+}
+
+// parseJob is a single datagram's payload waiting to be split into lines
+// and parsed by a parser worker.
+type parseJob struct {
+	peer    *net.UDPAddr
+	payload []byte
 }
 
 // NewUDP create new instance of UDP
 func NewUDP(out chan *points.Points) *UDP {
 	return &UDP{
-		out:            out,
-		exit:           make(chan bool),
-		finished:       make(chan bool),
-		metricInterval: time.Minute,
+		out:             out,
+		exit:            make(chan bool),
+		finished:        make(chan bool),
+		metricInterval:  time.Minute,
+		proxyProtocol:   ProxyProtocolDisabled,
+		logger:          logrusLogger{},
+		batchSize:       64,
+		parserWorkers:   4,
+		parseQueueSize:  1024,
+		parseDropPolicy: ParseDropPolicyBlock,
+		parser:          plainTextParser{},
 	}
 }
 
-type incompleteRecord struct {
-	deadline time.Time
-	data     []byte
+// rawDatagram is a single received UDP datagram together with its sender
+// address, as returned by a batchReader.
+type rawDatagram struct {
+	peer *net.UDPAddr
+	data []byte
 }
 
-// incompleteStorage store incomplete lines
-type incompleteStorage struct {
-	Records   map[string]*incompleteRecord
-	Expires   time.Duration
-	NextPurge time.Time
-	MaxSize   int
+// batchReader drains as many datagrams as the platform allows in a single
+// syscall. newBatchReader picks the implementation for the current OS.
+type batchReader interface {
+	readBatch() ([]rawDatagram, error)
+	close() error
 }
 
-func newIncompleteStorage() *incompleteStorage {
-	return &incompleteStorage{
-		Records:   make(map[string]*incompleteRecord, 0),
-		Expires:   5 * time.Second,
-		MaxSize:   10000,
-		NextPurge: time.Now().Add(time.Second),
-	}
+// SetLogIncomplete enable or disable incomplete messages logging
+func (rcv *UDP) SetLogIncomplete(value bool) {
+	rcv.logIncomplete = value
 }
 
-func (storage *incompleteStorage) store(addr string, data []byte) {
-	storage.Records[addr] = &incompleteRecord{
-		deadline: time.Now().Add(storage.Expires),
-		data:     data,
-	}
-	storage.checkAndClear()
+// SetMetricInterval sets doChekpoint interval
+func (rcv *UDP) SetMetricInterval(interval time.Duration) {
+	rcv.metricInterval = interval
 }
 
-func (storage *incompleteStorage) pop(addr string) []byte {
-	if record, ok := storage.Records[addr]; ok {
-		delete(storage.Records, addr)
-		if record.deadline.Before(time.Now()) {
-			return nil
-		}
-		return record.data
+// SetLogger overrides the Logger used by the receiver, e.g. to route
+// "[udp] incomplete message" and error events into an application's own
+// structured logging stack. Defaults to a logrus-backed adapter.
+func (rcv *UDP) SetLogger(logger Logger) {
+	rcv.logger = logger
+}
+
+// SetBatchSize sets how many datagrams a single recvmmsg(2) syscall tries
+// to drain on Linux (default 64). Ignored on platforms without batched
+// reads, where one datagram is read per syscall regardless.
+func (rcv *UDP) SetBatchSize(n int) {
+	rcv.batchSize = n
+}
+
+// SetReadBufferSize tunes the socket's SO_RCVBUF via net.UDPConn. Like the
+// other Set* config methods, call it before Listen: Listen applies it to
+// the bound socket automatically before starting the read loop.
+func (rcv *UDP) SetReadBufferSize(bytes int) error {
+	rcv.readBufferSize = bytes
+	if rcv.conn != nil {
+		return rcv.conn.SetReadBuffer(bytes)
 	}
 	return nil
 }
 
-func (storage *incompleteStorage) purge() {
-	now := time.Now()
-	for key, record := range storage.Records {
-		if record.deadline.Before(now) {
-			delete(storage.Records, key)
-		}
-	}
-	storage.NextPurge = time.Now().Add(time.Second)
+// SetParserWorkers sets the size of the parser worker pool that turns raw
+// datagrams into points (default 4). Each worker owns a fixed subset of
+// peers (by hash of the peer address) so incomplete-line continuations from
+// the same peer are always handled in order by the same worker.
+func (rcv *UDP) SetParserWorkers(n int) {
+	rcv.parserWorkers = n
 }
 
-func (storage *incompleteStorage) checkAndClear() {
-	if len(storage.Records) < storage.MaxSize {
-		return
-	}
-	if storage.NextPurge.After(time.Now()) {
-		return
+// SetParseQueueSize sets the per-worker bounded queue depth (default 1024).
+func (rcv *UDP) SetParseQueueSize(n int) {
+	rcv.parseQueueSize = n
+}
+
+// SetParseDropPolicy selects what happens when a parser worker's queue is
+// full: "block" (default) applies backpressure to the receive goroutine,
+// "drop" discards the datagram and counts it in udp.parseDrops.
+func (rcv *UDP) SetParseDropPolicy(policy string) error {
+	switch ParseDropPolicy(policy) {
+	case ParseDropPolicyBlock, ParseDropPolicyDrop:
+		rcv.parseDropPolicy = ParseDropPolicy(policy)
+		return nil
+	default:
+		return fmt.Errorf("unknown parse drop policy %#v", policy)
 	}
-	storage.purge()
 }
 
-// SetLogIncomplete enable or disable incomplete messages logging
-func (rcv *UDP) SetLogIncomplete(value bool) {
-	rcv.logIncomplete = value
+// SetIncompleteMaxBytes sets the total byte budget across all shards of the
+// incomplete-line storage (default ~20MB). Whichever bound is hit first,
+// this one or the existing entry-count limit, evicts the least recently
+// used fragment.
+func (rcv *UDP) SetIncompleteMaxBytes(n int) {
+	rcv.incompleteMaxBytes = n
 }
 
-// SetMetricInterval sets doChekpoint interval
-func (rcv *UDP) SetMetricInterval(interval time.Duration) {
-	rcv.metricInterval = interval
+// SetProxyProtocol enables parsing of a HAProxy PROXY protocol (v1 or v2)
+// header so metrics keep the real client address when go-carbon sits behind
+// an L4 load balancer. mode must be one of "disabled", "optional" or
+// "required".
+//
+// This only configures a single UDP receiver instance. This tree has no TCP
+// receiver and no "listeners" config section to extend, so per-listener
+// proxy-protocol config (multiple receivers with different settings sharing
+// one config file) is out of scope here; it belongs with whatever introduces
+// that config section and a TCP receiver in the first place.
+func (rcv *UDP) SetProxyProtocol(mode string) error {
+	switch ProxyProtocolMode(mode) {
+	case ProxyProtocolDisabled, ProxyProtocolOptional, ProxyProtocolRequired:
+		rcv.proxyProtocol = ProxyProtocolMode(mode)
+		return nil
+	default:
+		return fmt.Errorf("unknown proxy protocol mode %#v", mode)
+	}
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -131,23 +205,19 @@ func (rcv *UDP) Stat(metric string, value float64) {
 	)
 }
 
-func logIncomplete(peer *net.UDPAddr, message []byte, lastLine []byte) {
+func (rcv *UDP) warnIncomplete(peer *net.UDPAddr, message []byte, lastLine []byte) {
 	p1 := bytes.IndexByte(message, 0xa) // find first "\n"
 
 	if p1 != -1 && p1+len(lastLine) < len(message)-10 { // print short version
-		logrus.Warningf(
-			"[udp] incomplete message from %s: \"%s\\n...(%d bytes)...\\n%s\"",
-			peer.String(),
-			string(message[:p1]),
-			len(message)-p1-len(lastLine)-2,
-			string(lastLine),
-		)
+		rcv.logger.Warn("[udp] incomplete message", map[string]interface{}{
+			"peer":    peer.String(),
+			"message": fmt.Sprintf("\"%s\\n...(%d bytes)...\\n%s\"", string(message[:p1]), len(message)-p1-len(lastLine)-2, string(lastLine)),
+		})
 	} else { // print full
-		logrus.Warningf(
-			"[udp] incomplete message from %s: %#v",
-			peer.String(),
-			string(message),
-		)
+		rcv.logger.Warn("[udp] incomplete message", map[string]interface{}{
+			"peer":    peer.String(),
+			"message": string(message),
+		})
 	}
 }
 
@@ -159,6 +229,27 @@ func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 		return err
 	}
 
+	if rcv.readBufferSize > 0 {
+		if err := rcv.conn.SetReadBuffer(rcv.readBufferSize); err != nil {
+			return err
+		}
+	}
+
+	workers := rcv.parserWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	rcv.parseQueues = make([]chan parseJob, workers)
+	for i := range rcv.parseQueues {
+		rcv.parseQueues[i] = make(chan parseJob, rcv.parseQueueSize)
+	}
+
+	rcv.lines = newIncompleteStorage()
+	if rcv.incompleteMaxBytes > 0 {
+		rcv.lines.MaxBytes = rcv.incompleteMaxBytes
+	}
+
 	go func() {
 		ticker := time.NewTicker(rcv.metricInterval)
 		defer ticker.Stop()
@@ -178,11 +269,31 @@ func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 				atomic.AddUint32(&rcv.errors, -errors)
 				rcv.Stat("udp.errors", float64(errors))
 
-				logrus.WithFields(logrus.Fields{
+				batchReads := atomic.LoadUint32(&rcv.batchReads)
+				atomic.AddUint32(&rcv.batchReads, -batchReads)
+				batchDatagrams := atomic.LoadUint32(&rcv.batchDatagrams)
+				atomic.AddUint32(&rcv.batchDatagrams, -batchDatagrams)
+				if batchReads > 0 {
+					rcv.Stat("udp.batchSize", float64(batchDatagrams)/float64(batchReads))
+				}
+
+				depth := 0
+				for _, q := range rcv.parseQueues {
+					depth += len(q)
+				}
+				rcv.Stat("udp.parseQueueDepth", float64(depth))
+
+				parseDrops := atomic.LoadUint32(&rcv.parseDrops)
+				atomic.AddUint32(&rcv.parseDrops, -parseDrops)
+				rcv.Stat("udp.parseDrops", float64(parseDrops))
+
+				rcv.Stat("udp.incompleteEvicted", float64(rcv.lines.evictedCount()))
+
+				rcv.logger.Info("[udp] doCheckpoint()", map[string]interface{}{
 					"metricsReceived":    metricsReceived,
 					"incompleteReceived": incompleteReceived,
 					"errors":             errors,
-				}).Info("[udp] doCheckpoint()")
+				})
 
 			case <-rcv.exit:
 				rcv.conn.Close()
@@ -191,72 +302,207 @@ func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 		}
 	}()
 
-	go func() {
-		defer rcv.conn.Close()
+	var wg sync.WaitGroup
+	wg.Add(workers)
 
-		var buf [2048]byte
+	for i := 0; i < workers; i++ {
+		go func(queue chan parseJob) {
+			defer wg.Done()
+			rcv.parseWorker(queue)
+		}(rcv.parseQueues[i])
+	}
 
-		var data *bytes.Buffer
+	go func() {
+		defer rcv.conn.Close()
 
-		lines := newIncompleteStorage()
+		reader := newBatchReader(rcv.conn, rcv.batchSize)
 
 		for {
-			rlen, peer, err := rcv.conn.ReadFromUDP(buf[:])
+			datagrams, err := reader.readBatch()
 			if err != nil {
 				if strings.Contains(err.Error(), "use of closed network connection") {
 					break
 				}
 				atomic.AddUint32(&rcv.errors, 1)
-				logrus.Error(err)
+				rcv.logger.Error("[udp] read error", map[string]interface{}{"error": err})
 				continue
 			}
 
-			prev := lines.pop(peer.String())
+			atomic.AddUint32(&rcv.batchReads, 1)
+			atomic.AddUint32(&rcv.batchDatagrams, uint32(len(datagrams)))
+
+			for _, dgram := range datagrams {
+				peer := dgram.peer
+				payload := dgram.data
 
-			if prev != nil {
-				data = bytes.NewBuffer(prev)
-				data.Write(buf[:rlen])
-			} else {
-				data = bytes.NewBuffer(buf[:rlen])
+				if rcv.proxyProtocol != ProxyProtocolDisabled {
+					realPeer, rest, ok, err := parseProxyProtocolHeader(payload)
+					if err != nil {
+						atomic.AddUint32(&rcv.errors, 1)
+						rcv.logger.Warn("[udp] proxy protocol error", map[string]interface{}{"peer": peer.String(), "error": err})
+						continue
+					}
+					if !ok && rcv.proxyProtocol == ProxyProtocolRequired {
+						atomic.AddUint32(&rcv.errors, 1)
+						rcv.logger.Warn("[udp] missing required proxy protocol header", map[string]interface{}{"peer": peer.String()})
+						continue
+					}
+					if realPeer != nil {
+						peer = realPeer
+					}
+					payload = rest
+				}
+
+				// payload may alias a buffer the batch reader reuses on its
+				// next syscall, so copy it before handing it to a worker.
+				payloadCopy := make([]byte, len(payload))
+				copy(payloadCopy, payload)
+
+				queue := rcv.parseQueues[parseWorkerIndex(peer, workers)]
+				job := parseJob{peer: peer, payload: payloadCopy}
+				rcv.enqueueParseJob(queue, job)
 			}
+		}
 
-			for {
-				line, err := data.ReadBytes('\n')
+		reader.close()
+		for _, q := range rcv.parseQueues {
+			close(q)
+		}
+	}()
 
-				if err != nil {
-					if err == io.EOF {
-						if len(line) > 0 { // incomplete line received
+	go func() {
+		wg.Wait()
+		close(rcv.finished)
+	}()
+
+	return nil
+}
+
+// parseWorkerIndex picks the fixed worker responsible for peer, so that
+// incomplete-line continuations from the same peer are always handled by
+// the same worker and stay in order.
+func parseWorkerIndex(peer *net.UDPAddr, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(peer.String()))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// enqueueParseJob sends job to queue, applying rcv.parseDropPolicy when
+// queue is full: ParseDropPolicyDrop discards job and counts it in
+// rcv.parseDrops, ParseDropPolicyBlock waits for space.
+func (rcv *UDP) enqueueParseJob(queue chan parseJob, job parseJob) {
+	select {
+	case queue <- job:
+	default:
+		if rcv.parseDropPolicy == ParseDropPolicyDrop {
+			atomic.AddUint32(&rcv.parseDrops, 1)
+			return
+		}
+		queue <- job
+	}
+}
+
+// parseWorker consumes raw datagrams from queue and forwards parsed points
+// to rcv.out until queue is closed. rcv.lines is shared with the other
+// workers; it shards and locks internally so this needs no coordination
+// beyond that.
+func (rcv *UDP) parseWorker(queue chan parseJob) {
+	if rcv.datagramParser != nil {
+		rcv.parseWorkerDatagrams(queue)
+		return
+	}
+	rcv.parseWorkerLines(queue)
+}
 
-							if rcv.logIncomplete {
-								logIncomplete(peer, buf[:rlen], line)
-							}
+// parseWorkerLines reassembles newline-delimited text lines (joining
+// incomplete continuations from the peers routed to this worker) and runs
+// each through rcv.parser.
+func (rcv *UDP) parseWorkerLines(queue chan parseJob) {
+	var data *bytes.Buffer
 
-							lines.store(peer.String(), line)
-							atomic.AddUint32(&rcv.incompleteReceived, 1)
+	for job := range queue {
+		peer := job.peer
+		payload := job.payload
+
+		prev := rcv.lines.pop(peer.String())
+
+		if prev != nil {
+			data = bytes.NewBuffer(prev)
+			data.Write(payload)
+		} else {
+			data = bytes.NewBuffer(payload)
+		}
+
+		for {
+			line, err := data.ReadBytes('\n')
+
+			if err != nil {
+				if err == io.EOF {
+					if len(line) > 0 { // incomplete line received
+
+						if rcv.logIncomplete {
+							rcv.warnIncomplete(peer, payload, line)
 						}
-					} else {
-						atomic.AddUint32(&rcv.errors, 1)
-						logrus.Error(err)
+
+						rcv.lines.store(peer.String(), line)
+						atomic.AddUint32(&rcv.incompleteReceived, 1)
 					}
-					break
+				} else {
+					atomic.AddUint32(&rcv.errors, 1)
+					rcv.logger.Error("[udp] read error", map[string]interface{}{"peer": peer.String(), "error": err})
 				}
-				if len(line) > 0 { // skip empty lines
-					if msg, err := points.ParseText(string(line)); err != nil {
-						atomic.AddUint32(&rcv.errors, 1)
-						logrus.Info(err)
-					} else {
-						atomic.AddUint32(&rcv.metricsReceived, 1)
-						rcv.out <- msg
-					}
+				break
+			}
+			if len(line) > 0 { // skip empty lines
+				if msg, err := rcv.parser.Parse(bytes.TrimRight(line, "\r\n")); err != nil {
+					atomic.AddUint32(&rcv.errors, 1)
+					rcv.logger.Info("[udp] parse error", map[string]interface{}{"peer": peer.String(), "bytes": len(line), "error": err})
+				} else {
+					atomic.AddUint32(&rcv.metricsReceived, 1)
+					rcv.out <- msg
 				}
 			}
 		}
+	}
+}
 
-		close(rcv.finished)
+// parseWorkerDatagrams reassembles binary self-framed datagrams (joining
+// incomplete continuations from the peers routed to this worker) and runs
+// each through rcv.datagramParser, bypassing the newline-delimited line
+// splitter entirely since a binary payload can legitimately contain
+// 0x0A/0x0D bytes that are not message boundaries.
+func (rcv *UDP) parseWorkerDatagrams(queue chan parseJob) {
+	for job := range queue {
+		peer := job.peer
+		payload := job.payload
+
+		if prev := rcv.lines.pop(peer.String()); prev != nil {
+			joined := make([]byte, 0, len(prev)+len(payload))
+			joined = append(joined, prev...)
+			joined = append(joined, payload...)
+			payload = joined
+		}
 
-	}()
+		msgs, rest, err := rcv.datagramParser.ParseDatagram(payload)
+		if err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Info("[udp] parse error", map[string]interface{}{"peer": peer.String(), "bytes": len(payload), "error": err})
+			continue
+		}
 
-	return nil
+		if len(rest) > 0 {
+			if rcv.logIncomplete {
+				rcv.logger.Warn("[udp] incomplete message", map[string]interface{}{"peer": peer.String(), "bytes": len(rest)})
+			}
+			rcv.lines.store(peer.String(), rest)
+			atomic.AddUint32(&rcv.incompleteReceived, 1)
+		}
+
+		for _, msg := range msgs {
+			atomic.AddUint32(&rcv.metricsReceived, 1)
+			rcv.out <- msg
+		}
+	}
 }
 
 // Stop all listeners
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package receiver
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// linuxBatchReader drains up to batchSize datagrams per syscall using
+// recvmmsg(2), via golang.org/x/net/ipv4.PacketConn.ReadBatch.
+type linuxBatchReader struct {
+	pconn     *ipv4.PacketConn
+	batchSize int
+	msgs      []ipv4.Message
+}
+
+func newBatchReader(conn *net.UDPConn, batchSize int) batchReader {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 2048)}
+	}
+
+	return &linuxBatchReader{
+		pconn:     ipv4.NewPacketConn(conn),
+		batchSize: batchSize,
+		msgs:      msgs,
+	}
+}
+
+func (r *linuxBatchReader) readBatch() ([]rawDatagram, error) {
+	n, err := r.pconn.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]rawDatagram, 0, n)
+	for i := 0; i < n; i++ {
+		msg := r.msgs[i]
+		peer, ok := msg.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		out = append(out, rawDatagram{peer: peer, data: msg.Buffers[0][:msg.N]})
+	}
+	return out, nil
+}
+
+func (r *linuxBatchReader) close() error {
+	return r.pconn.Close()
+}
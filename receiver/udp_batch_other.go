@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package receiver
+
+import "net"
+
+// fallbackBatchReader emulates the batchReader interface on platforms
+// without recvmmsg(2) support by reading a single datagram per call.
+type fallbackBatchReader struct {
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func newBatchReader(conn *net.UDPConn, batchSize int) batchReader {
+	return &fallbackBatchReader{
+		conn: conn,
+		buf:  make([]byte, 2048),
+	}
+}
+
+func (r *fallbackBatchReader) readBatch() ([]rawDatagram, error) {
+	rlen, peer, err := r.conn.ReadFromUDP(r.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, rlen)
+	copy(data, r.buf[:rlen])
+
+	return []rawDatagram{{peer: peer, data: data}}, nil
+}
+
+func (r *fallbackBatchReader) close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,46 @@
+package receiver
+
+import (
+	"net"
+	"testing"
+)
+
+// TestBatchReaderReadsDatagram exercises whichever batchReader
+// implementation this platform compiles (linuxBatchReader via recvmmsg, or
+// fallbackBatchReader elsewhere) through the shared newBatchReader
+// constructor, since both must satisfy the same peer/payload contract that
+// Listen relies on.
+func TestBatchReaderReadsDatagram(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer serverConn.Close()
+
+	clientConn, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("hello world")); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+
+	reader := newBatchReader(serverConn, 64)
+	defer reader.close()
+
+	datagrams, err := reader.readBatch()
+	if err != nil {
+		t.Fatalf("readBatch failed: %s", err)
+	}
+	if len(datagrams) != 1 {
+		t.Fatalf("expected 1 datagram, got %d", len(datagrams))
+	}
+	if string(datagrams[0].data) != "hello world" {
+		t.Fatalf("unexpected payload: %#v", string(datagrams[0].data))
+	}
+	if datagrams[0].peer == nil || datagrams[0].peer.Port != clientConn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("unexpected peer: %#v", datagrams[0].peer)
+	}
+}
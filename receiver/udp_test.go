@@ -0,0 +1,95 @@
+package receiver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestParseWorkerIndexIsStablePerPeer(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 35230}
+
+	first := parseWorkerIndex(peer, 4)
+	for i := 0; i < 10; i++ {
+		// A fresh *net.UDPAddr with the same value must route to the same
+		// worker every time, since incomplete-line continuations from one
+		// peer have to stay ordered on a single worker.
+		again := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 35230}
+		if got := parseWorkerIndex(again, 4); got != first {
+			t.Fatalf("expected stable routing, got %d then %d", first, got)
+		}
+	}
+	if first < 0 || first >= 4 {
+		t.Fatalf("worker index %d out of range", first)
+	}
+}
+
+func TestSetParseDropPolicyRejectsUnknown(t *testing.T) {
+	rcv := NewUDP(make(chan *points.Points))
+
+	if err := rcv.SetParseDropPolicy("drop"); err != nil {
+		t.Fatalf("unexpected error for valid policy: %s", err)
+	}
+	if rcv.parseDropPolicy != ParseDropPolicyDrop {
+		t.Fatalf("expected parseDropPolicy to be set to drop")
+	}
+
+	if err := rcv.SetParseDropPolicy("bogus"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestEnqueueParseJobDropsWhenQueueFull(t *testing.T) {
+	rcv := NewUDP(make(chan *points.Points))
+	rcv.parseDropPolicy = ParseDropPolicyDrop
+
+	queue := make(chan parseJob, 1)
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	rcv.enqueueParseJob(queue, parseJob{peer: peer, payload: []byte("a")})
+	rcv.enqueueParseJob(queue, parseJob{peer: peer, payload: []byte("b")}) // queue full, must be dropped
+
+	if rcv.parseDrops != 1 {
+		t.Fatalf("expected 1 dropped job, got %d", rcv.parseDrops)
+	}
+	if len(queue) != 1 {
+		t.Fatalf("expected the queue to still only hold the first job, got %d", len(queue))
+	}
+
+	job := <-queue
+	if string(job.payload) != "a" {
+		t.Fatalf("expected the first job to have been kept, got %#v", string(job.payload))
+	}
+}
+
+func TestEnqueueParseJobBlocksUntilSpace(t *testing.T) {
+	rcv := NewUDP(make(chan *points.Points))
+	rcv.parseDropPolicy = ParseDropPolicyBlock
+
+	queue := make(chan parseJob, 1)
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	rcv.enqueueParseJob(queue, parseJob{peer: peer, payload: []byte("a")})
+
+	done := make(chan struct{})
+	go func() {
+		rcv.enqueueParseJob(queue, parseJob{peer: peer, payload: []byte("b")})
+		close(done)
+	}()
+
+	// Drain the first job; only then can the blocked send above complete.
+	first := <-queue
+	if string(first.payload) != "a" {
+		t.Fatalf("unexpected first job: %#v", string(first.payload))
+	}
+
+	<-done // would hang here if enqueueParseJob dropped instead of blocking
+	second := <-queue
+	if string(second.payload) != "b" {
+		t.Fatalf("unexpected second job: %#v", string(second.payload))
+	}
+	if rcv.parseDrops != 0 {
+		t.Fatalf("expected no drops under the block policy, got %d", rcv.parseDrops)
+	}
+}